@@ -1,34 +1,127 @@
 package staticcache
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrCacheCorrupt is returned when a cached payload fails its checksum check.
+// The caller should fall back to fetching the resource from origin.
+var ErrCacheCorrupt = errors.New("staticcache: cached file is corrupt")
+
+// metaFileSuffix is appended to a cached file's path to form the sidecar
+// metadata file that lets the cache survive process restarts.
+const metaFileSuffix = ".meta"
+
+// cacheFileNameReplacer sanitizes a cache key (which may now contain a query
+// string and a variant hash) into a flat, filesystem-safe file name.
+var cacheFileNameReplacer = strings.NewReplacer("/", "_", "?", "_", "&", "_", "=", "_", ":", "_")
+
 type StaticCachedFile struct {
-	FilePath    string // The file path of the cached file
-	ContentType string // The MIME type of the cached file
-	ExpiryTime  int64  // The Unix timestamp when the cache expires
+	FilePath        string // The file path of the cached file
+	ContentType     string // The MIME type of the cached file
+	ExpiryTime      int64  // The Unix timestamp when the cache expires
+	Checksum        []byte // SHA-256 checksum of the cached payload, used to detect bitrot
+	RequestPath     string // The original request path this entry was stored under, needed to revalidate against origin
+	ETag            string // The upstream ETag header, if any, used for conditional requests
+	LastModified    string // The upstream Last-Modified header, if any, used for conditional requests
+	CacheControl    string // The upstream Cache-Control header, if any, used to derive outbound caching behaviour
+	Vary            string // The upstream Vary header, if any
+	ContentEncoding string // The upstream Content-Encoding header, if any, e.g. "gzip" or "br" for a negotiated variant
+	Size            int64  // Size of the cached payload in bytes, used for quota accounting
+	LastAccessUnix  int64  // The Unix timestamp this entry was stored or last returned by GetCachedFile; eviction order comes from the pool's LRU list, not this field
+	HitCount        int64  // Number of times this entry has been served from cache
+}
+
+// OriginFetchFunc issues a conditional GET to the origin for requestPath,
+// setting If-None-Match / If-Modified-Since from etag / lastModified when non-empty.
+type OriginFetchFunc func(ctx context.Context, requestPath string, etag string, lastModified string) (*http.Response, error)
+
+// PartialFetchFunc fetches the complete object for requestPath from origin,
+// used to fill the disk cache in the background after a Range request.
+type PartialFetchFunc func(ctx context.Context, requestPath string) (content []byte, headers http.Header, err error)
+
+// persistedCacheEntry is the JSON sidecar representation of a cache entry.
+type persistedCacheEntry struct {
+	Key  string
+	File StaticCachedFile
 }
 
 type StaticCacheConfig struct {
-	Enabled        bool     // Whether static caching is enabled on this proxy rule
-	Timeout        int64    // How long to cache static files in seconds
-	MaxFileSize    int64    // Maximum file size to cache in bytes
-	FileExtensions []string // File extensions to cache, e.g. []string{".css", ".js", ".png"}
-	SkipSubpaths   []string // Subpaths to skip caching, e.g. []string{"/api/", "/admin/"}
-	CacheFileDir   string   // Directory to store cached files
+	Enabled           bool     // Whether static caching is enabled on this proxy rule
+	Timeout           int64    // How long to cache static files in seconds
+	MaxFileSize       int64    // Maximum file size to cache in bytes
+	FileExtensions    []string // File extensions to cache, e.g. []string{".css", ".js", ".png"}
+	SkipSubpaths      []string // Subpaths to skip caching, e.g. []string{"/api/", "/admin/"}
+	CacheFileDir      string   // Directory to store cached files
+	After             int      // Number of hits required within the rolling window before a file is written to disk
+	MaxTotalSize      int64    // Total disk usage ceiling in bytes across this pool, 0 means unlimited
+	Quota             int      // Low-watermark as a percent of MaxTotalSize to evict down to once the ceiling is hit, e.g. 80
+	IgnoreQueryParams []string // Query parameter names to drop before cache-key generation, e.g. []string{"utm_*"}. A trailing "*" matches by prefix.
+}
+
+// CacheStats is a snapshot of a pool's disk usage and hit/miss counters.
+type CacheStats struct {
+	BytesUsed     int64 // Total bytes currently stored on disk
+	EntryCount    int64 // Number of cached entries currently tracked
+	HitCount      int64 // Number of GetCachedFile calls that found a live entry
+	MissCount     int64 // Number of GetCachedFile calls that found nothing or an expired entry
+	EvictionCount int64 // Number of entries evicted to stay under MaxTotalSize
+}
+
+// CacheDecision is the tri-state result of ShouldCacheRequest.
+type CacheDecision int
+
+const (
+	CacheDecisionSkip      CacheDecision = iota // request is not cacheable, e.g. disabled, skipped path or extension
+	CacheDecisionCountOnly                      // request is cacheable but has not been requested After times yet
+	CacheDecisionStore                          // request has met the After threshold and should be stored
+)
+
+// hitCounter tracks hits to a path within the rolling window defined by
+// StaticCacheConfig.Timeout.
+type hitCounter struct {
+	count         int64
+	firstSeenUnix int64
 }
 
 type StaticCacheResourcesPool struct {
-	config      *StaticCacheConfig
-	cachedFiles sync.Map // in the type of map[string]*StaticCachedFile
+	config         *StaticCacheConfig
+	cachedFiles    sync.Map // in the type of map[string]*StaticCachedFile
+	hitCounters    sync.Map // in the type of map[string]*hitCounter
+	originFetcher  OriginFetchFunc
+	partialFetcher PartialFetchFunc
+
+	currentSize   int64 // total bytes on disk, accessed atomically
+	entryCount    int64 // number of cached entries, accessed atomically
+	hitCount      int64 // GetCachedFile hits, accessed atomically
+	missCount     int64 // GetCachedFile misses, accessed atomically
+	evictionCount int64 // entries evicted to stay under quota, accessed atomically
+
+	lruMu    sync.Mutex // guards lruList and lruIndex
+	lruList  *list.List // front = most recently used cacheKey, back = least recently used
+	lruIndex map[string]*list.Element
+
+	varyByBaseKey sync.Map // in the type of map[string]string, the Vary header recorded for a base (path+query) key
 }
 
 func NewStaticCacheResourcesPool(config *StaticCacheConfig) *StaticCacheResourcesPool {
@@ -38,21 +131,89 @@ func NewStaticCacheResourcesPool(config *StaticCacheConfig) *StaticCacheResource
 			os.MkdirAll(config.CacheFileDir, 0755)
 		}
 	}
-	return &StaticCacheResourcesPool{
+
+	pool := &StaticCacheResourcesPool{
 		config:      config,
 		cachedFiles: sync.Map{},
+		hitCounters: sync.Map{},
+		lruList:     list.New(),
+		lruIndex:    make(map[string]*list.Element),
+	}
+	pool.loadPersistedCache()
+	return pool
+}
+
+// loadPersistedCache restores cache entries from their .meta sidecar files,
+// discarding any whose payload is missing or already expired.
+func (pool *StaticCacheResourcesPool) loadPersistedCache() {
+	if pool.config.CacheFileDir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(pool.config.CacheFileDir)
+	if err != nil {
+		return
+	}
+
+	currentTime := time.Now().Unix()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), metaFileSuffix) {
+			continue
+		}
+
+		metaPath := filepath.Join(pool.config.CacheFileDir, entry.Name())
+		raw, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+
+		var persisted persistedCacheEntry
+		if err := json.Unmarshal(raw, &persisted); err != nil {
+			continue
+		}
+
+		if currentTime > persisted.File.ExpiryTime {
+			os.Remove(metaPath)
+			pool.removeFileFromDisk(persisted.File.FilePath)
+			continue
+		}
+
+		if _, err := os.Stat(persisted.File.FilePath); err != nil {
+			// Payload is gone, the sidecar is now orphaned
+			os.Remove(metaPath)
+			continue
+		}
+
+		cachedFile := persisted.File
+		pool.cachedFiles.Store(persisted.Key, &cachedFile)
+		pool.trackEntry(persisted.Key, &cachedFile)
+		if cachedFile.Vary != "" {
+			baseKey, _, _ := strings.Cut(persisted.Key, "::")
+			pool.varyByBaseKey.Store(baseKey, cachedFile.Vary)
+		}
 	}
 }
 
 // GetDefaultStaticCacheConfig returns a default static cache configuration
 func GetDefaultStaticCacheConfig(cacheFolderDir string) *StaticCacheConfig {
+	after := 0
+	if envAfter := os.Getenv("MIN_HITS_BEFORE_CACHE"); envAfter != "" {
+		if parsed, err := strconv.Atoi(envAfter); err == nil && parsed >= 0 {
+			after = parsed
+		}
+	}
+
 	return &StaticCacheConfig{
-		Enabled:        false,
-		Timeout:        3600,             // 1 hourt
-		MaxFileSize:    25 * 1024 * 1024, // 25 MB
-		FileExtensions: []string{".html", ".css", ".js", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".woff", ".woff2", ".ttf", ".eot"},
-		SkipSubpaths:   []string{},
-		CacheFileDir:   cacheFolderDir,
+		Enabled:           false,
+		Timeout:           3600,             // 1 hourt
+		MaxFileSize:       25 * 1024 * 1024, // 25 MB
+		FileExtensions:    []string{".html", ".css", ".js", ".png", ".jpg", ".jpeg", ".gif", ".svg", ".woff", ".woff2", ".ttf", ".eot"},
+		SkipSubpaths:      []string{},
+		CacheFileDir:      cacheFolderDir,
+		After:             after, // 0 means cache on first request, preserving previous behaviour
+		MaxTotalSize:      0,     // 0 means unlimited disk usage, preserving previous behaviour
+		Quota:             80,    // evict down to 80% of MaxTotalSize once the ceiling is hit
+		IgnoreQueryParams: []string{},
 	}
 }
 
@@ -64,21 +225,34 @@ func (pool *StaticCacheResourcesPool) GetConfig() *StaticCacheConfig {
 	return pool.config
 }
 
+// SetOriginFetcher configures the hook Revalidate uses to issue conditional
+// GET requests upstream.
+func (pool *StaticCacheResourcesPool) SetOriginFetcher(fetcher OriginFetchFunc) {
+	pool.originFetcher = fetcher
+}
+
+// SetPartialFetcher configures the hook BackgroundFillFromRange uses to fetch
+// the complete object from origin.
+func (pool *StaticCacheResourcesPool) SetPartialFetcher(fetcher PartialFetchFunc) {
+	pool.partialFetcher = fetcher
+}
+
 // CheckFileSizeShouldBeCached checks if the file size is within the limit to be cached
 func (pool *StaticCacheResourcesPool) CheckFileSizeShouldBeCached(contentLength int64) bool {
 	return pool.config.MaxFileSize <= 0 || contentLength <= pool.config.MaxFileSize
 }
 
-// ShouldCacheRequest checks if a request should be cached based on the configuration
-func (pool *StaticCacheResourcesPool) ShouldCacheRequest(requestPath string) bool {
+// ShouldCacheRequest checks if a request is cacheable and has met the After
+// hit threshold. It does not mutate hit counters; call RecordHitAndDecide for that.
+func (pool *StaticCacheResourcesPool) ShouldCacheRequest(requestPath string) CacheDecision {
 	if !pool.config.Enabled {
-		return false
+		return CacheDecisionSkip
 	}
 
 	// Check if path should be skipped
 	for _, skipPath := range pool.config.SkipSubpaths {
 		if strings.Contains(requestPath, skipPath) {
-			return false
+			return CacheDecisionSkip
 		}
 	}
 
@@ -90,22 +264,63 @@ func (pool *StaticCacheResourcesPool) ShouldCacheRequest(requestPath string) boo
 			break
 		}
 	}
-	return found
+	if !found {
+		return CacheDecisionSkip
+	}
+
+	if pool.config.After <= 0 {
+		return CacheDecisionStore
+	}
+
+	if counter, exists := pool.hitCounters.Load(requestPath); exists {
+		if atomic.LoadInt64(&counter.(*hitCounter).count) >= int64(pool.config.After) {
+			return CacheDecisionStore
+		}
+	}
+	return CacheDecisionCountOnly
 }
 
-// GetCachedFile retrieves a cached file if it exists and is not expired
-func (pool *StaticCacheResourcesPool) GetCachedFile(requestPath string) (*StaticCachedFile, bool) {
-	cacheKey := pool.generateCacheKey(requestPath)
+// RecordHitAndDecide increments the rolling hit counter for requestPath and
+// reports whether the After threshold has now been met.
+func (pool *StaticCacheResourcesPool) RecordHitAndDecide(requestPath string) bool {
+	now := time.Now().Unix()
+
+	value, _ := pool.hitCounters.LoadOrStore(requestPath, &hitCounter{
+		count:         0,
+		firstSeenUnix: now,
+	})
+	counter := value.(*hitCounter)
+
+	// Roll the window if it has expired since the first recorded hit
+	if pool.config.Timeout > 0 && now-atomic.LoadInt64(&counter.firstSeenUnix) > pool.config.Timeout {
+		atomic.StoreInt64(&counter.firstSeenUnix, now)
+		atomic.StoreInt64(&counter.count, 0)
+	}
+
+	newCount := atomic.AddInt64(&counter.count, 1)
+	if pool.config.After <= 0 {
+		return true
+	}
+	return newCount >= int64(pool.config.After)
+}
+
+// GetCachedFile retrieves a cached file if it exists and is not expired,
+// bumping LastAccessUnix/HitCount and the LRU on a hit. requestHeaders selects
+// the right variant when the stored entry's origin response carried Vary.
+func (pool *StaticCacheResourcesPool) GetCachedFile(requestPath string, requestHeaders http.Header) (*StaticCachedFile, bool) {
+	cacheKey := pool.resolveVariantKey(pool.generateCacheKey(requestPath), requestHeaders)
 
 	value, exists := pool.cachedFiles.Load(cacheKey)
 
 	if !exists {
+		atomic.AddInt64(&pool.missCount, 1)
 		return nil, false
 	}
 
 	cachedFile, ok := value.(*StaticCachedFile)
 
 	if !ok {
+		atomic.AddInt64(&pool.missCount, 1)
 		return nil, false
 	}
 
@@ -114,26 +329,286 @@ func (pool *StaticCacheResourcesPool) GetCachedFile(requestPath string) (*Static
 		// Remove expired cache
 		pool.cachedFiles.Delete(cacheKey)
 		pool.removeFileFromDisk(cachedFile.FilePath)
+		pool.untrackEntry(cacheKey, cachedFile)
+		atomic.AddInt64(&pool.missCount, 1)
 		return nil, false
 	}
 
+	atomic.StoreInt64(&cachedFile.LastAccessUnix, time.Now().Unix())
+	atomic.AddInt64(&cachedFile.HitCount, 1)
+	atomic.AddInt64(&pool.hitCount, 1)
+	pool.touchLRU(cacheKey)
+
 	return cachedFile, true
 }
 
-// generateCacheKey creates a unique key for caching based on the request path
+// generateCacheKey builds a base cache key from requestPath's path and its
+// query parameters (sorted, with IgnoreQueryParams matches dropped). See
+// resolveVariantKey for how this maps onto the variant actually stored.
 func (pool *StaticCacheResourcesPool) generateCacheKey(requestPath string) string {
-	// Use the request path as the key, normalized
-	return strings.TrimPrefix(requestPath, "/")
+	path, query := pool.normalizePathAndQuery(requestPath)
+	cacheKey := strings.TrimPrefix(path, "/")
+	if query != "" {
+		cacheKey += "?" + query
+	}
+	return cacheKey
 }
 
-// removeFileFromDisk removes a cached file from disk
+// normalizePathAndQuery splits requestPath into its path and a stable,
+// filtered query string suitable for inclusion in a cache key.
+func (pool *StaticCacheResourcesPool) normalizePathAndQuery(requestPath string) (path string, sortedQuery string) {
+	parsed, err := url.Parse(requestPath)
+	if err != nil {
+		return requestPath, ""
+	}
+
+	values := parsed.Query()
+	for key := range values {
+		if pool.isIgnoredQueryParam(key) {
+			delete(values, key)
+		}
+	}
+	if len(values) == 0 {
+		return parsed.Path, ""
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		vals := append([]string(nil), values[key]...)
+		sort.Strings(vals)
+		parts = append(parts, key+"="+strings.Join(vals, ","))
+	}
+	return parsed.Path, strings.Join(parts, "&")
+}
+
+// isIgnoredQueryParam reports whether key matches one of the configured
+// IgnoreQueryParams patterns. A trailing "*" on a pattern matches by prefix,
+// e.g. "utm_*" matches "utm_source" and "utm_campaign".
+func (pool *StaticCacheResourcesPool) isIgnoredQueryParam(key string) bool {
+	for _, pattern := range pool.config.IgnoreQueryParams {
+		if prefix, isWildcard := strings.CutSuffix(pattern, "*"); isWildcard {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+			continue
+		}
+		if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveVariantKey combines baseKey with the variant selected by
+// requestHeaders, per the Vary header recorded for baseKey at store time.
+// Paths with no recorded Vary resolve to baseKey itself.
+func (pool *StaticCacheResourcesPool) resolveVariantKey(baseKey string, requestHeaders http.Header) string {
+	varyValue := ""
+	if stored, ok := pool.varyByBaseKey.Load(baseKey); ok {
+		varyValue = stored.(string)
+	}
+
+	variantHash := computeVariantHash(varyValue, requestHeaders)
+	if variantHash == "" {
+		return baseKey
+	}
+	return baseKey + "::" + variantHash
+}
+
+// computeVariantHash derives a short, stable discriminator for varyValue and
+// requestHeaders, normalizing Accept-Encoding so equivalent values collapse
+// onto one variant. Returns "" when there is nothing to vary on.
+func computeVariantHash(varyValue string, requestHeaders http.Header) string {
+	varyValue = strings.TrimSpace(varyValue)
+	if varyValue == "" || varyValue == "*" {
+		return ""
+	}
+
+	fields := strings.Split(varyValue, ",")
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		name := strings.TrimSpace(field)
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "Accept-Encoding") {
+			parts = append(parts, "accept-encoding="+normalizeAcceptEncoding(requestHeaders.Get("Accept-Encoding")))
+			continue
+		}
+		parts = append(parts, strings.ToLower(name)+"="+requestHeaders.Get(name))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	sort.Strings(parts)
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "&")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// normalizeAcceptEncoding collapses an Accept-Encoding header down to the
+// single encoding zoraxy will serve, preferring br over gzip over identity.
+func normalizeAcceptEncoding(acceptEncoding string) string {
+	lower := strings.ToLower(acceptEncoding)
+	for _, encoding := range []string{"br", "gzip"} {
+		for _, candidate := range strings.Split(lower, ",") {
+			if strings.TrimSpace(strings.SplitN(candidate, ";", 2)[0]) == encoding {
+				return encoding
+			}
+		}
+	}
+	return "identity"
+}
+
+// touchLRU marks cacheKey as most recently used, adding it to the LRU if it
+// is not already tracked.
+func (pool *StaticCacheResourcesPool) touchLRU(cacheKey string) {
+	pool.lruMu.Lock()
+	defer pool.lruMu.Unlock()
+
+	if element, exists := pool.lruIndex[cacheKey]; exists {
+		pool.lruList.MoveToFront(element)
+		return
+	}
+	pool.lruIndex[cacheKey] = pool.lruList.PushFront(cacheKey)
+}
+
+// removeLRU stops tracking cacheKey in the LRU, e.g. once its entry has been
+// deleted for any reason (expiry, corruption, eviction).
+func (pool *StaticCacheResourcesPool) removeLRU(cacheKey string) {
+	pool.lruMu.Lock()
+	defer pool.lruMu.Unlock()
+
+	if element, exists := pool.lruIndex[cacheKey]; exists {
+		pool.lruList.Remove(element)
+		delete(pool.lruIndex, cacheKey)
+	}
+}
+
+// trackEntry accounts for a newly stored or restored cache entry in the size
+// and entry-count totals and the LRU.
+func (pool *StaticCacheResourcesPool) trackEntry(cacheKey string, cachedFile *StaticCachedFile) {
+	atomic.AddInt64(&pool.currentSize, cachedFile.Size)
+	atomic.AddInt64(&pool.entryCount, 1)
+	pool.touchLRU(cacheKey)
+}
+
+// untrackEntry reverses trackEntry for an entry being removed from the pool.
+func (pool *StaticCacheResourcesPool) untrackEntry(cacheKey string, cachedFile *StaticCachedFile) {
+	atomic.AddInt64(&pool.currentSize, -cachedFile.Size)
+	atomic.AddInt64(&pool.entryCount, -1)
+	pool.removeLRU(cacheKey)
+}
+
+// lowWatermark returns the total size, in bytes, the pool should be evicted
+// down to once MaxTotalSize is exceeded.
+func (pool *StaticCacheResourcesPool) lowWatermark() int64 {
+	quota := pool.config.Quota
+	if quota <= 0 || quota > 100 {
+		quota = 80
+	}
+	return pool.config.MaxTotalSize * int64(quota) / 100
+}
+
+// reserveCapacity does nothing while growthBytes more usage fits under
+// MaxTotalSize; otherwise it evicts least-recently-used entries until usage
+// plus growthBytes is at or under the low watermark (see lowWatermark), or
+// nothing is left to evict. excludeKey, if non-empty, is never evicted,
+// protecting a key its caller is in the middle of writing.
+func (pool *StaticCacheResourcesPool) reserveCapacity(growthBytes int64, excludeKey string) {
+	if pool.config.MaxTotalSize <= 0 {
+		return
+	}
+	if atomic.LoadInt64(&pool.currentSize)+growthBytes <= pool.config.MaxTotalSize {
+		return
+	}
+
+	low := pool.lowWatermark()
+	for atomic.LoadInt64(&pool.currentSize)+growthBytes > low {
+		if !pool.evictLeastRecentlyUsed(excludeKey) {
+			break
+		}
+	}
+}
+
+// evictLeastRecentlyUsed removes the single oldest entry from the pool and
+// disk, skipping excludeKey if it is the oldest. It reports whether an entry
+// was found to evict.
+func (pool *StaticCacheResourcesPool) evictLeastRecentlyUsed(excludeKey string) bool {
+	pool.lruMu.Lock()
+	element := pool.lruList.Back()
+	for element != nil && excludeKey != "" && element.Value.(string) == excludeKey {
+		element = element.Prev()
+	}
+	if element == nil {
+		pool.lruMu.Unlock()
+		return false
+	}
+	cacheKey := element.Value.(string)
+	pool.lruList.Remove(element)
+	delete(pool.lruIndex, cacheKey)
+	pool.lruMu.Unlock()
+
+	value, exists := pool.cachedFiles.LoadAndDelete(cacheKey)
+	if !exists {
+		return true
+	}
+	cachedFile := value.(*StaticCachedFile)
+	pool.removeFileFromDisk(cachedFile.FilePath)
+	atomic.AddInt64(&pool.currentSize, -cachedFile.Size)
+	atomic.AddInt64(&pool.entryCount, -1)
+	atomic.AddInt64(&pool.evictionCount, 1)
+	return true
+}
+
+// Stats returns a snapshot of the pool's current disk usage, entry count, and
+// hit/miss/eviction counters, for rendering cache health in the Zoraxy UI.
+func (pool *StaticCacheResourcesPool) Stats() CacheStats {
+	return CacheStats{
+		BytesUsed:     atomic.LoadInt64(&pool.currentSize),
+		EntryCount:    atomic.LoadInt64(&pool.entryCount),
+		HitCount:      atomic.LoadInt64(&pool.hitCount),
+		MissCount:     atomic.LoadInt64(&pool.missCount),
+		EvictionCount: atomic.LoadInt64(&pool.evictionCount),
+	}
+}
+
+// removeFileFromDisk removes a cached file and its sidecar metadata from disk
 func (pool *StaticCacheResourcesPool) removeFileFromDisk(filePath string) {
 	os.Remove(filePath)
+	os.Remove(filePath + metaFileSuffix)
+}
+
+// writeMetaFile persists cachedFile's metadata next to its payload.
+func (pool *StaticCacheResourcesPool) writeMetaFile(cacheKey string, cachedFile *StaticCachedFile) error {
+	raw, err := json.Marshal(persistedCacheEntry{Key: cacheKey, File: *cachedFile})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cachedFile.FilePath+metaFileSuffix, raw, 0644)
 }
 
-// StoreCachedFile stores a file in the cache with the given content and expiry time
-func (pool *StaticCacheResourcesPool) StoreCachedFile(requestPath, contentType string, content []byte) error {
-	cacheKey := pool.generateCacheKey(requestPath)
+// StoreCachedFile stores a file in the cache with the given content and expiry
+// time. upstreamHeaders' ETag, Last-Modified, Cache-Control and Vary values
+// are persisted alongside the entry. If the origin marked the response
+// no-store, the entry is not cached.
+func (pool *StaticCacheResourcesPool) StoreCachedFile(requestPath, contentType string, content []byte, upstreamHeaders http.Header, requestHeaders http.Header) error {
+	cacheControl := upstreamHeaders.Get("Cache-Control")
+	if hasCacheControlDirective(cacheControl, "no-store") {
+		return nil
+	}
+
+	baseKey := pool.generateCacheKey(requestPath)
+	if varyValue := upstreamHeaders.Get("Vary"); varyValue != "" {
+		pool.varyByBaseKey.Store(baseKey, varyValue)
+	}
+	cacheKey := pool.resolveVariantKey(baseKey, requestHeaders)
 
 	// Create cache directory if it doesn't exist
 	cacheDir := pool.config.CacheFileDir
@@ -146,7 +621,7 @@ func (pool *StaticCacheResourcesPool) StoreCachedFile(requestPath, contentType s
 	}
 
 	// Generate file path
-	fileName := strings.ReplaceAll(cacheKey, "/", "_")
+	fileName := cacheFileNameReplacer.Replace(cacheKey)
 	filePath := filepath.Join(cacheDir, fileName)
 
 	// Write content to file
@@ -157,25 +632,117 @@ func (pool *StaticCacheResourcesPool) StoreCachedFile(requestPath, contentType s
 	// Calculate expiry time
 	expiryTime := time.Now().Add(time.Duration(pool.config.Timeout) * time.Second).Unix()
 
+	// Checksum the payload so bitrot can be detected when it is served back
+	checksum := sha256.Sum256(content)
+
 	// Store in memory cache
 	cachedFile := &StaticCachedFile{
-		FilePath:    filePath,
-		ContentType: contentType,
-		ExpiryTime:  expiryTime,
+		FilePath:        filePath,
+		ContentType:     contentType,
+		ExpiryTime:      expiryTime,
+		Checksum:        checksum[:],
+		RequestPath:     requestPath,
+		ETag:            upstreamHeaders.Get("ETag"),
+		LastModified:    upstreamHeaders.Get("Last-Modified"),
+		CacheControl:    cacheControl,
+		Vary:            upstreamHeaders.Get("Vary"),
+		ContentEncoding: upstreamHeaders.Get("Content-Encoding"),
+		Size:            int64(len(content)),
+		LastAccessUnix:  time.Now().Unix(),
+	}
+
+	if err := pool.writeMetaFile(cacheKey, cachedFile); err != nil {
+		return err
 	}
 
-	pool.cachedFiles.Store(cacheKey, cachedFile)
+	// Swap atomically so concurrent stores to the same new cacheKey can't both
+	// observe "not present" and double-count entryCount/currentSize.
+	previous, loaded := pool.cachedFiles.Swap(cacheKey, cachedFile)
+	var previousSize int64
+	if loaded {
+		if previousFile, ok := previous.(*StaticCachedFile); ok {
+			previousSize = previousFile.Size
+		}
+	}
+	pool.reserveCapacity(cachedFile.Size-previousSize, cacheKey)
+
+	atomic.AddInt64(&pool.currentSize, cachedFile.Size-previousSize)
+	if !loaded {
+		atomic.AddInt64(&pool.entryCount, 1)
+	}
+	pool.touchLRU(cacheKey)
 	return nil
 }
 
-// ServeCachedFile serves a cached file to the HTTP response writer
-func (pool *StaticCacheResourcesPool) ServeCachedFile(w http.ResponseWriter, cachedFile *StaticCachedFile) error {
+// hasCacheControlDirective reports whether directive is present in a
+// Cache-Control header value, e.g. hasCacheControlDirective("no-store, private", "no-store") == true.
+func hasCacheControlDirective(cacheControl, directive string) bool {
+	for _, part := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveOutboundCacheControl builds the outbound Cache-Control header,
+// falling back to the configured Timeout when the origin did not specify one.
+func (pool *StaticCacheResourcesPool) deriveOutboundCacheControl(cachedFile *StaticCachedFile) string {
+	if cachedFile.CacheControl != "" {
+		// Respect no-store/private/must-revalidate etc. exactly as the origin sent them
+		return cachedFile.CacheControl
+	}
+	return fmt.Sprintf("public, max-age=%d", pool.config.Timeout)
+}
+
+// ServeCachedFile serves a cached file, verifying its checksum as it is read.
+// A 304 is sent instead of the body if r's conditional headers match.
+func (pool *StaticCacheResourcesPool) ServeCachedFile(w http.ResponseWriter, r *http.Request, cachedFile *StaticCachedFile) error {
+	if cachedFile.Vary != "" {
+		w.Header().Set("Vary", cachedFile.Vary)
+	}
+	if cachedFile.ETag != "" {
+		w.Header().Set("ETag", cachedFile.ETag)
+	}
+	if cachedFile.LastModified != "" {
+		w.Header().Set("Last-Modified", cachedFile.LastModified)
+	}
+	if cachedFile.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", cachedFile.ContentEncoding)
+	}
+	w.Header().Set("Cache-Control", pool.deriveOutboundCacheControl(cachedFile))
+
+	if pool.isNotModified(r, cachedFile) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
 	file, err := os.Open(cachedFile.FilePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Read and hash the payload before writing anything to the client, so a
+	// corrupt entry never reaches the response body
+	var buf bytes.Buffer
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(&buf, hasher), file)
+	if err != nil {
+		return err
+	}
+
+	if written != info.Size() || !bytes.Equal(hasher.Sum(nil), cachedFile.Checksum) {
+		pool.evictCorruptEntry(cachedFile)
+		log.Printf("[staticcache] bitrot detected in %s, evicting cached entry", cachedFile.FilePath)
+		return ErrCacheCorrupt
+	}
+
 	// Set content type
 	if cachedFile.ContentType != "" {
 		w.Header().Set("Content-Type", cachedFile.ContentType)
@@ -187,15 +754,269 @@ func (pool *StaticCacheResourcesPool) ServeCachedFile(w http.ResponseWriter, cac
 		}
 	}
 
-	// Set cache headers
-	w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour in browser
-
-	// Copy file content to response
-	_, err = io.Copy(w, file)
+	// Copy verified content to response
+	_, err = w.Write(buf.Bytes())
 	return err
 }
 
-// RemoveExpiredCache removes all expired cached files from memory and disk
+// isNotModified reports whether r's conditional request headers indicate the
+// client already has a fresh copy of cachedFile.
+func (pool *StaticCacheResourcesPool) isNotModified(r *http.Request, cachedFile *StaticCachedFile) bool {
+	if r == nil {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && cachedFile.ETag != "" {
+		return inm == cachedFile.ETag || inm == "*"
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && cachedFile.LastModified != "" {
+		sinceTime, err1 := http.ParseTime(ims)
+		modifiedTime, err2 := http.ParseTime(cachedFile.LastModified)
+		if err1 == nil && err2 == nil {
+			return !modifiedTime.After(sinceTime)
+		}
+	}
+
+	return false
+}
+
+// Revalidate issues a conditional GET upstream for cachedFile. A 304 refreshes
+// ExpiryTime in place and reports fresh; a 200 replaces the payload and reports stale.
+func (pool *StaticCacheResourcesPool) Revalidate(ctx context.Context, cachedFile *StaticCachedFile) (fresh bool, err error) {
+	if pool.originFetcher == nil {
+		return false, errors.New("staticcache: no origin fetcher configured")
+	}
+
+	resp, err := pool.originFetcher(ctx, cachedFile.RequestPath, cachedFile.ETag, cachedFile.LastModified)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	cacheKey, found := pool.findCacheKey(cachedFile)
+	if !found {
+		cacheKey = pool.generateCacheKey(cachedFile.RequestPath)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		cachedFile.ExpiryTime = time.Now().Add(time.Duration(pool.config.Timeout) * time.Second).Unix()
+		if err := pool.writeMetaFile(cacheKey, cachedFile); err != nil {
+			return true, err
+		}
+		return true, nil
+	case http.StatusOK:
+		content, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return false, err
+		}
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = cachedFile.ContentType
+		}
+		if err := pool.replaceCachedFilePayload(cacheKey, cachedFile, contentType, content, resp.Header); err != nil {
+			return false, err
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("staticcache: unexpected upstream status %d during revalidation", resp.StatusCode)
+	}
+}
+
+// findCacheKey locates the (possibly variant-suffixed) key cachedFile is
+// stored under, by identity, for callers that only have the entry itself.
+func (pool *StaticCacheResourcesPool) findCacheKey(cachedFile *StaticCachedFile) (string, bool) {
+	var found string
+	ok := false
+	pool.cachedFiles.Range(func(key, value interface{}) bool {
+		if value.(*StaticCachedFile) == cachedFile {
+			found = key.(string)
+			ok = true
+			return false
+		}
+		return true
+	})
+	return found, ok
+}
+
+// replaceCachedFilePayload overwrites an entry's on-disk payload and metadata
+// by publishing a new StaticCachedFile under cacheKey, rather than mutating
+// the shared cachedFile in place, since it may be concurrently read by
+// GetCachedFile / ServeCachedFile. A no-store upstream response evicts the
+// entry instead.
+func (pool *StaticCacheResourcesPool) replaceCachedFilePayload(cacheKey string, cachedFile *StaticCachedFile, contentType string, content []byte, upstreamHeaders http.Header) error {
+	cacheControl := upstreamHeaders.Get("Cache-Control")
+	if hasCacheControlDirective(cacheControl, "no-store") {
+		pool.cachedFiles.Delete(cacheKey)
+		pool.removeFileFromDisk(cachedFile.FilePath)
+		pool.untrackEntry(cacheKey, cachedFile)
+		return nil
+	}
+
+	if err := os.WriteFile(cachedFile.FilePath, content, 0644); err != nil {
+		return err
+	}
+
+	checksum := sha256.Sum256(content)
+	previousSize := cachedFile.Size
+
+	updated := &StaticCachedFile{
+		FilePath:        cachedFile.FilePath,
+		ContentType:     contentType,
+		ExpiryTime:      time.Now().Add(time.Duration(pool.config.Timeout) * time.Second).Unix(),
+		Checksum:        checksum[:],
+		RequestPath:     cachedFile.RequestPath,
+		ETag:            upstreamHeaders.Get("ETag"),
+		LastModified:    upstreamHeaders.Get("Last-Modified"),
+		CacheControl:    cacheControl,
+		Vary:            upstreamHeaders.Get("Vary"),
+		ContentEncoding: upstreamHeaders.Get("Content-Encoding"),
+		Size:            int64(len(content)),
+		LastAccessUnix:  time.Now().Unix(),
+	}
+
+	if err := pool.writeMetaFile(cacheKey, updated); err != nil {
+		return err
+	}
+
+	pool.cachedFiles.Store(cacheKey, updated)
+	pool.reserveCapacity(updated.Size-previousSize, cacheKey)
+	atomic.AddInt64(&pool.currentSize, updated.Size-previousSize)
+	pool.touchLRU(cacheKey)
+	return nil
+}
+
+// ServeCachedFileRange serves a fully-cached file via http.ServeContent for
+// correct 206 Partial Content handling. Unlike ServeCachedFile it does not
+// re-hash the payload first, since http.ServeContent may only read part of
+// the file; range requests rely on the periodic VerifyAll() scrub instead.
+func (pool *StaticCacheResourcesPool) ServeCachedFileRange(w http.ResponseWriter, r *http.Request, cachedFile *StaticCachedFile) error {
+	file, err := os.Open(cachedFile.FilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if cachedFile.Vary != "" {
+		w.Header().Set("Vary", cachedFile.Vary)
+	}
+	if cachedFile.ETag != "" {
+		w.Header().Set("ETag", cachedFile.ETag)
+	}
+	if cachedFile.LastModified != "" {
+		w.Header().Set("Last-Modified", cachedFile.LastModified)
+	}
+	if cachedFile.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", cachedFile.ContentEncoding)
+	}
+	w.Header().Set("Cache-Control", pool.deriveOutboundCacheControl(cachedFile))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if cachedFile.ContentType != "" {
+		w.Header().Set("Content-Type", cachedFile.ContentType)
+	} else if mimeType := mime.TypeByExtension(filepath.Ext(cachedFile.FilePath)); mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+
+	modTime, err := http.ParseTime(cachedFile.LastModified)
+	if err != nil {
+		modTime = time.Unix(0, 0)
+	}
+
+	// http.ServeContent parses the Range header, handles conditional requests
+	// against modTime, and writes 206/200/304/416 as appropriate.
+	http.ServeContent(w, r, filepath.Base(cachedFile.FilePath), modTime, file)
+	return nil
+}
+
+// BackgroundFillFromRange asynchronously fetches and stores the complete
+// object for requestPath, for callers that just served a Range request
+// directly from origin and want it cached for next time. It returns
+// immediately and only logs fetch/store errors. The fill is still subject to
+// ShouldCacheRequest and the After hit threshold like any other store.
+func (pool *StaticCacheResourcesPool) BackgroundFillFromRange(ctx context.Context, requestPath, contentType string, requestHeaders http.Header) {
+	if pool.partialFetcher == nil {
+		return
+	}
+	if pool.ShouldCacheRequest(requestPath) == CacheDecisionSkip {
+		return
+	}
+	if !pool.RecordHitAndDecide(requestPath) {
+		return
+	}
+
+	// Detach from the triggering request's context so the fill survives the
+	// client disconnecting or the original request timing out.
+	fillCtx := context.WithoutCancel(ctx)
+
+	go func() {
+		content, headers, err := pool.partialFetcher(fillCtx, requestPath)
+		if err != nil {
+			log.Printf("[staticcache] background range fill failed for %s: %v", requestPath, err)
+			return
+		}
+
+		ct := contentType
+		if headerCT := headers.Get("Content-Type"); headerCT != "" {
+			ct = headerCT
+		}
+
+		if err := pool.StoreCachedFile(requestPath, ct, content, headers, requestHeaders); err != nil {
+			log.Printf("[staticcache] background range fill store failed for %s: %v", requestPath, err)
+		}
+	}()
+}
+
+// evictCorruptEntry removes a cached file that failed checksum verification.
+func (pool *StaticCacheResourcesPool) evictCorruptEntry(cachedFile *StaticCachedFile) {
+	pool.cachedFiles.Range(func(key, value interface{}) bool {
+		if value.(*StaticCachedFile) == cachedFile {
+			pool.cachedFiles.Delete(key)
+			pool.untrackEntry(key.(string), cachedFile)
+			return false
+		}
+		return true
+	})
+	pool.removeFileFromDisk(cachedFile.FilePath)
+}
+
+// VerifyAll re-hashes every cached entry against its stored checksum and
+// evicts any that have rotted, for use as a periodic admin scrub.
+func (pool *StaticCacheResourcesPool) VerifyAll() (checked int, evicted int) {
+	pool.cachedFiles.Range(func(key, value interface{}) bool {
+		cachedFile, ok := value.(*StaticCachedFile)
+		if !ok {
+			return true
+		}
+		checked++
+
+		content, err := os.ReadFile(cachedFile.FilePath)
+		if err != nil {
+			pool.cachedFiles.Delete(key)
+			pool.removeFileFromDisk(cachedFile.FilePath)
+			pool.untrackEntry(key.(string), cachedFile)
+			evicted++
+			return true
+		}
+
+		sum := sha256.Sum256(content)
+		if !bytes.Equal(sum[:], cachedFile.Checksum) {
+			pool.cachedFiles.Delete(key)
+			pool.removeFileFromDisk(cachedFile.FilePath)
+			pool.untrackEntry(key.(string), cachedFile)
+			log.Printf("[staticcache] bitrot detected in %s during VerifyAll, evicting cached entry", cachedFile.FilePath)
+			evicted++
+		}
+
+		return true
+	})
+
+	return checked, evicted
+}
+
+// RemoveExpiredCache removes all expired cached files from memory and disk,
+// and ages out stale hit counters.
 func (pool *StaticCacheResourcesPool) RemoveExpiredCache() {
 	currentTime := time.Now().Unix()
 
@@ -210,6 +1031,21 @@ func (pool *StaticCacheResourcesPool) RemoveExpiredCache() {
 			pool.cachedFiles.Delete(key)
 			// Remove from disk
 			pool.removeFileFromDisk(cachedFile.FilePath)
+			pool.untrackEntry(key.(string), cachedFile)
+		}
+
+		return true
+	})
+
+	window := pool.config.Timeout
+	pool.hitCounters.Range(func(key, value interface{}) bool {
+		counter, ok := value.(*hitCounter)
+		if !ok {
+			return true
+		}
+
+		if window > 0 && currentTime-atomic.LoadInt64(&counter.firstSeenUnix) > window {
+			pool.hitCounters.Delete(key)
 		}
 
 		return true
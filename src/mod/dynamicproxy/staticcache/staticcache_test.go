@@ -0,0 +1,414 @@
+package staticcache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestConfig(t *testing.T) *StaticCacheConfig {
+	cfg := GetDefaultStaticCacheConfig(t.TempDir())
+	cfg.Enabled = true
+	return cfg
+}
+
+func TestShouldCacheRequestSkipsDisabled(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Enabled = false
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	if got := pool.ShouldCacheRequest("/a.js"); got != CacheDecisionSkip {
+		t.Fatalf("got %v, want CacheDecisionSkip", got)
+	}
+}
+
+func TestShouldCacheRequestSkipsSubpathAndExtension(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.SkipSubpaths = []string{"/admin/"}
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	if got := pool.ShouldCacheRequest("/admin/app.js"); got != CacheDecisionSkip {
+		t.Fatalf("got %v, want CacheDecisionSkip for skipped subpath", got)
+	}
+	if got := pool.ShouldCacheRequest("/a.unknownext"); got != CacheDecisionSkip {
+		t.Fatalf("got %v, want CacheDecisionSkip for unlisted extension", got)
+	}
+}
+
+func TestShouldCacheRequestAfterThreshold(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.After = 3
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	for i := 0; i < 2; i++ {
+		if pool.RecordHitAndDecide("/a.js") {
+			t.Fatalf("hit %d: RecordHitAndDecide returned true before threshold", i)
+		}
+		if got := pool.ShouldCacheRequest("/a.js"); got != CacheDecisionCountOnly {
+			t.Fatalf("hit %d: got %v, want CacheDecisionCountOnly", i, got)
+		}
+	}
+
+	if !pool.RecordHitAndDecide("/a.js") {
+		t.Fatal("RecordHitAndDecide returned false at threshold")
+	}
+	if got := pool.ShouldCacheRequest("/a.js"); got != CacheDecisionStore {
+		t.Fatalf("got %v, want CacheDecisionStore at threshold", got)
+	}
+}
+
+func TestRecordHitAndDecideConcurrent(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.After = 50
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	done := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				pool.RecordHitAndDecide("/a.js")
+				pool.ShouldCacheRequest("/a.js")
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+}
+
+func emptyHeaders() http.Header {
+	return http.Header{}
+}
+
+func TestServeCachedFileDetectsBitrot(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	if err := pool.StoreCachedFile("/a.js", "text/javascript", []byte("console.log(1)"), emptyHeaders(), emptyHeaders()); err != nil {
+		t.Fatalf("StoreCachedFile: %v", err)
+	}
+	cachedFile, ok := pool.GetCachedFile("/a.js", emptyHeaders())
+	if !ok {
+		t.Fatal("expected cache hit after store")
+	}
+
+	if err := os.WriteFile(cachedFile.FilePath, []byte("tampered"), 0644); err != nil {
+		t.Fatalf("corrupting cached file: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/a.js", nil)
+	if err := pool.ServeCachedFile(rec, req, cachedFile); err != ErrCacheCorrupt {
+		t.Fatalf("got err %v, want ErrCacheCorrupt", err)
+	}
+
+	if _, ok := pool.GetCachedFile("/a.js", emptyHeaders()); ok {
+		t.Fatal("corrupt entry should have been evicted")
+	}
+}
+
+func TestServeCachedFileNotModifiedByETag(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	upstream := emptyHeaders()
+	upstream.Set("ETag", `"v1"`)
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("console.log(1)"), upstream, emptyHeaders())
+	cachedFile, _ := pool.GetCachedFile("/a.js", emptyHeaders())
+
+	req := httptest.NewRequest(http.MethodGet, "/a.js", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	if err := pool.ServeCachedFile(rec, req, cachedFile); err != nil {
+		t.Fatalf("ServeCachedFile: %v", err)
+	}
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestServeCachedFileNotModifiedByLastModified(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+	upstream := emptyHeaders()
+	upstream.Set("Last-Modified", lastModified)
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("console.log(1)"), upstream, emptyHeaders())
+	cachedFile, _ := pool.GetCachedFile("/a.js", emptyHeaders())
+
+	req := httptest.NewRequest(http.MethodGet, "/a.js", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rec := httptest.NewRecorder()
+	if err := pool.ServeCachedFile(rec, req, cachedFile); err != nil {
+		t.Fatalf("ServeCachedFile: %v", err)
+	}
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestServeCachedFileRangeServesPartialContent(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	content := []byte("0123456789")
+	pool.StoreCachedFile("/a.bin", "application/octet-stream", content, emptyHeaders(), emptyHeaders())
+	cachedFile, _ := pool.GetCachedFile("/a.bin", emptyHeaders())
+
+	req := httptest.NewRequest(http.MethodGet, "/a.bin", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rec := httptest.NewRecorder()
+	if err := pool.ServeCachedFileRange(rec, req, cachedFile); err != nil {
+		t.Fatalf("ServeCachedFileRange: %v", err)
+	}
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got := rec.Body.String(); got != "234" {
+		t.Fatalf("got body %q, want %q", got, "234")
+	}
+}
+
+func TestBackgroundFillFromRangeRespectsHitThreshold(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.After = 2
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	var fetchCount int32
+	pool.SetPartialFetcher(func(ctx context.Context, requestPath string) ([]byte, http.Header, error) {
+		atomic.AddInt32(&fetchCount, 1)
+		return []byte("full object"), emptyHeaders(), nil
+	})
+
+	pool.BackgroundFillFromRange(context.Background(), "/a.js", "application/octet-stream", emptyHeaders())
+	if got := atomic.LoadInt32(&fetchCount); got != 0 {
+		t.Fatalf("fetchCount = %d on first range request, want 0 below the After threshold", got)
+	}
+
+	pool.BackgroundFillFromRange(context.Background(), "/a.js", "application/octet-stream", emptyHeaders())
+	waitForFetch(t, &fetchCount, 1)
+}
+
+// waitForFetch polls fetchCount, since BackgroundFillFromRange's store runs
+// on a detached goroutine.
+func waitForFetch(t *testing.T, fetchCount *int32, want int32) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(fetchCount) >= want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("fetchCount = %d, want >= %d", atomic.LoadInt32(fetchCount), want)
+}
+
+func TestReserveCapacityEvictsLeastRecentlyUsed(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.MaxTotalSize = 100
+	cfg.Quota = 80
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	pool.StoreCachedFile("/a.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	pool.StoreCachedFile("/b.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	pool.StoreCachedFile("/c.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+
+	if _, ok := pool.GetCachedFile("/a.js", emptyHeaders()); ok {
+		t.Fatal("/a.js should have been evicted as least recently used")
+	}
+	if _, ok := pool.GetCachedFile("/c.js", emptyHeaders()); !ok {
+		t.Fatal("/c.js should still be cached")
+	}
+}
+
+func TestStoreCachedFileDoesNotSelfEvict(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.MaxTotalSize = 100
+	cfg.Quota = 80
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	// /a.js is the oldest entry in the LRU, so re-storing it with a bigger
+	// payload must not let reserveCapacity evict the very entry being written.
+	pool.StoreCachedFile("/a.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	pool.StoreCachedFile("/b.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	if err := pool.StoreCachedFile("/a.js", "text/javascript", make([]byte, 60), emptyHeaders(), emptyHeaders()); err != nil {
+		t.Fatalf("StoreCachedFile: %v", err)
+	}
+
+	cachedFile, ok := pool.GetCachedFile("/a.js", emptyHeaders())
+	if !ok {
+		t.Fatal("/a.js should still be cached after re-storing it")
+	}
+	if _, err := os.Stat(cachedFile.FilePath); err != nil {
+		t.Fatalf("/a.js payload missing from disk: %v", err)
+	}
+}
+
+func TestReplaceCachedFilePayloadDoesNotSelfEvict(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.MaxTotalSize = 100
+	cfg.Quota = 80
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	pool.StoreCachedFile("/a.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	pool.StoreCachedFile("/b.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+	cachedFile, _ := pool.GetCachedFile("/a.js", emptyHeaders())
+	cacheKey, found := pool.findCacheKey(cachedFile)
+	if !found {
+		t.Fatal("findCacheKey: /a.js entry not found")
+	}
+
+	if err := pool.replaceCachedFilePayload(cacheKey, cachedFile, "text/javascript", make([]byte, 60), emptyHeaders()); err != nil {
+		t.Fatalf("replaceCachedFilePayload: %v", err)
+	}
+
+	if _, err := os.Stat(cachedFile.FilePath); err != nil {
+		t.Fatalf("/a.js payload missing from disk: %v", err)
+	}
+}
+
+func TestContentEncodingRoundTrips(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/a.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	upstream := emptyHeaders()
+	upstream.Set("Vary", "Accept-Encoding")
+	upstream.Set("Content-Encoding", "gzip")
+	if err := pool.StoreCachedFile("/a.js", "text/javascript", []byte("gzipped-bytes"), upstream, req.Header); err != nil {
+		t.Fatalf("StoreCachedFile: %v", err)
+	}
+	cachedFile, ok := pool.GetCachedFile("/a.js", req.Header)
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if cachedFile.ContentEncoding != "gzip" {
+		t.Fatalf("got ContentEncoding %q, want %q", cachedFile.ContentEncoding, "gzip")
+	}
+
+	rec := httptest.NewRecorder()
+	if err := pool.ServeCachedFile(rec, req, cachedFile); err != nil {
+		t.Fatalf("ServeCachedFile: %v", err)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding header %q, want %q", got, "gzip")
+	}
+}
+
+func TestResolveVariantKeySelectsByAcceptEncoding(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	gzipHeaders := emptyHeaders()
+	gzipHeaders.Set("Content-Encoding", "gzip")
+	gzipReq := emptyHeaders()
+	gzipReq.Set("Accept-Encoding", "gzip")
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("gzip-body"), withVary(gzipHeaders), gzipReq)
+
+	identityHeaders := emptyHeaders()
+	identityReq := emptyHeaders()
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("plain-body"), withVary(identityHeaders), identityReq)
+
+	gzipFile, ok := pool.GetCachedFile("/a.js", gzipReq)
+	if !ok || string(mustReadFile(t, gzipFile.FilePath)) != "gzip-body" {
+		t.Fatal("expected gzip variant to be served for Accept-Encoding: gzip")
+	}
+
+	identityFile, ok := pool.GetCachedFile("/a.js", identityReq)
+	if !ok || string(mustReadFile(t, identityFile.FilePath)) != "plain-body" {
+		t.Fatal("expected identity variant to be served when Accept-Encoding is absent")
+	}
+}
+
+func withVary(h http.Header) http.Header {
+	h.Set("Vary", "Accept-Encoding")
+	return h
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return content
+}
+
+func TestStoreCachedFileConcurrentSameKeyDoesNotDoubleCount(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.StoreCachedFile("/a.js", "text/javascript", make([]byte, 50), emptyHeaders(), emptyHeaders())
+		}()
+	}
+	wg.Wait()
+
+	stats := pool.Stats()
+	if stats.EntryCount != 1 {
+		t.Fatalf("got EntryCount %d, want 1 after concurrent stores to the same key", stats.EntryCount)
+	}
+	if stats.BytesUsed != 50 {
+		t.Fatalf("got BytesUsed %d, want 50 after concurrent stores to the same key", stats.BytesUsed)
+	}
+}
+
+func TestReplaceCachedFilePayloadConcurrentWithGetCachedFile(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("v1"), emptyHeaders(), emptyHeaders())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			pool.GetCachedFile("/a.js", emptyHeaders())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			cachedFile, ok := pool.GetCachedFile("/a.js", emptyHeaders())
+			if !ok {
+				continue
+			}
+			cacheKey, ok := pool.findCacheKey(cachedFile)
+			if !ok {
+				continue
+			}
+			pool.replaceCachedFilePayload(cacheKey, cachedFile, "text/javascript", []byte("v2"), emptyHeaders())
+		}
+	}()
+	wg.Wait()
+}
+
+func TestVerifyAllEvictsCorruptEntries(t *testing.T) {
+	cfg := newTestConfig(t)
+	pool := NewStaticCacheResourcesPool(cfg)
+
+	pool.StoreCachedFile("/a.js", "text/javascript", []byte("console.log(1)"), emptyHeaders(), emptyHeaders())
+	cachedFile, _ := pool.GetCachedFile("/a.js", emptyHeaders())
+	os.WriteFile(cachedFile.FilePath, []byte("tampered"), 0644)
+
+	checked, evicted := pool.VerifyAll()
+	if checked != 1 || evicted != 1 {
+		t.Fatalf("got checked=%d evicted=%d, want checked=1 evicted=1", checked, evicted)
+	}
+	if _, ok := pool.GetCachedFile("/a.js", emptyHeaders()); ok {
+		t.Fatal("corrupt entry should have been evicted by VerifyAll")
+	}
+}